@@ -0,0 +1,179 @@
+package waddrmgr
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcwallet/internal/zero"
+)
+
+// defaultKeyCacheSize bounds how many scope+account xpubs (and, while
+// unlocked, their matching private keys) LocalKeyMaker keeps resident at
+// once. It's sized generously above what a single wallet typically
+// touches in one rescan so the cache stays effectively unbounded in
+// practice while still protecting against unbounded growth from a
+// pathological caller.
+const defaultKeyCacheSize = 250
+
+// keyCacheKey identifies a single cached extended key: either the
+// coin-type key for a scope (isCoinType true, account ignored), or a
+// specific account key within that scope.
+type keyCacheKey struct {
+	scope      KeyScope
+	account    uint32
+	isCoinType bool
+}
+
+// keyCacheEntry holds the neutered form of a cached key, plus its
+// private form while the manager is unlocked. The private key is kept
+// as its serialized bytes, not a parsed *hdkeychain.ExtendedKey, so that
+// Lock() can zero it in place the same way the rest of this package
+// zeroes decrypted key material.
+type keyCacheEntry struct {
+	key            keyCacheKey
+	pubKey         *hdkeychain.ExtendedKey
+	privSerialized []byte
+}
+
+// keyCache is a bounded LRU cache of the keyCacheEntry values described
+// above, eliminating the repeated master-key decryption that otherwise
+// happens on every call to DeriveCoinTypeKey/DeriveAccountKey.
+//
+// locked mirrors the owning LocalKeyMaker's lock state, but is read and
+// written under the same mutex as every insert: that's what keeps
+// putPrivate and lock() from racing each other and leaving private key
+// material behind after a Lock() call returns.
+type keyCache struct {
+	mu      sync.Mutex
+	maxLen  int
+	locked  bool
+	ll      *list.List
+	entries map[keyCacheKey]*list.Element
+}
+
+func newKeyCache(maxLen int) *keyCache {
+	return &keyCache{
+		maxLen:  maxLen,
+		ll:      list.New(),
+		entries: make(map[keyCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached entry for key, if any, marking it as most
+// recently used.
+func (c *keyCache) get(key keyCacheKey) (*keyCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*keyCacheEntry), true
+}
+
+// put inserts or replaces entry, evicting the least recently used entry
+// if the cache is over capacity.
+func (c *keyCache) put(entry *keyCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.putLocked(entry)
+}
+
+// putPrivate inserts or replaces the entry for key with pubKey and,
+// provided the cache isn't currently locked, privKey's serialized form.
+// Whether the cache is locked is checked under the same mutex as the
+// insert itself, so a concurrent lock() can never land in between and
+// be left with a private key it just zeroed everything else to avoid
+// holding.
+func (c *keyCache) putPrivate(key keyCacheKey, pubKey, privKey *hdkeychain.ExtendedKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &keyCacheEntry{key: key, pubKey: pubKey}
+	if !c.locked {
+		entry.privSerialized = []byte(privKey.String())
+	}
+
+	c.putLocked(entry)
+}
+
+// putLocked is the shared insert path for put and putPrivate. The caller
+// must hold c.mu.
+func (c *keyCache) putLocked(entry *keyCacheEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value = entry
+		return
+	}
+
+	elem := c.ll.PushFront(entry)
+	c.entries[entry.key] = elem
+
+	for c.ll.Len() > c.maxLen {
+		c.evictOldest()
+	}
+}
+
+// evictOldest drops the least recently used entry, zeroing any cached
+// private key material first. The caller must hold c.mu.
+func (c *keyCache) evictOldest() {
+	elem := c.ll.Back()
+	if elem == nil {
+		return
+	}
+
+	c.removeElement(elem)
+}
+
+// removeElement drops elem from the cache, zeroing any cached private
+// key material first. The caller must hold c.mu.
+func (c *keyCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*keyCacheEntry)
+	zero.Bytes(entry.privSerialized)
+
+	c.ll.Remove(elem)
+	delete(c.entries, entry.key)
+}
+
+// invalidate drops the cached entry for key, if any.
+func (c *keyCache) invalidate(key keyCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// lock marks the cache locked and zeroes and drops every cached private
+// key, leaving the neutered public keys in place. LocalKeyMaker only
+// serves entries that still hold a private key, so it does not return
+// these public-only entries while locked. Setting the flag and wiping existing entries
+// under the same mutex closes the window a concurrent putPrivate could
+// otherwise use to insert a private key right after it's been cleared.
+func (c *keyCache) lock() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locked = true
+
+	for _, elem := range c.entries {
+		entry := elem.Value.(*keyCacheEntry)
+		zero.Bytes(entry.privSerialized)
+		entry.privSerialized = nil
+	}
+}
+
+// unlock marks the cache unlocked, allowing private keys to be cached by
+// putPrivate going forward.
+func (c *keyCache) unlock() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locked = false
+}
@@ -0,0 +1,351 @@
+package waddrmgr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/karalabe/hid"
+)
+
+// hwRequest is the envelope sent to the device for every call, modeled on
+// HWI's own JSON-RPC-ish line protocol.
+type hwRequest struct {
+	Fingerprint string      `json:"fingerprint,omitempty"`
+	Method      string      `json:"method"`
+	Params      interface{} `json:"params,omitempty"`
+}
+
+// hwResponse is the envelope every transport expects back for a request.
+type hwResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// doCall marshals req, writes it followed by a newline to rw, reads a
+// single newline-delimited JSON response back from rw, and unpacks it. It is
+// shared by the stdio and TCP transports, which both speak the same
+// line-delimited framing.
+func doCall(rw *bufio.ReadWriter, req hwRequest) (json.RawMessage, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rw.Write(append(payload, '\n')); err != nil {
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var resp hwResponse
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &resp); err != nil {
+		return nil, fmt.Errorf("malformed hardware wallet response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("hardware wallet error: %s", resp.Error)
+	}
+
+	return resp.Result, nil
+}
+
+// hidTransport talks to a USB HID hardware wallet directly, the way HWI's
+// bundled device handlers do.
+type hidTransport struct {
+	mu      sync.Mutex
+	devices map[string]*hid.Device
+}
+
+func newHIDTransport() (HwTransport, error) {
+	if !hid.Supported() {
+		return nil, fmt.Errorf("USB HID is not supported on this platform")
+	}
+
+	return &hidTransport{devices: make(map[string]*hid.Device)}, nil
+}
+
+func (t *hidTransport) Enumerate() ([]HwDeviceInfo, error) {
+	var devices []HwDeviceInfo
+	for _, info := range hid.Enumerate(0, 0) {
+		devices = append(devices, HwDeviceInfo{
+			Fingerprint: info.Serial,
+			Type:        info.Product,
+			Path:        info.Path,
+		})
+	}
+
+	return devices, nil
+}
+
+func (t *hidTransport) device(fingerprint string) (*hid.Device, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if dev, ok := t.devices[fingerprint]; ok {
+		return dev, nil
+	}
+
+	for _, info := range hid.Enumerate(0, 0) {
+		if info.Serial != fingerprint {
+			continue
+		}
+
+		dev, err := info.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		t.devices[fingerprint] = dev
+		return dev, nil
+	}
+
+	return nil, fmt.Errorf("no hardware wallet with fingerprint %q found", fingerprint)
+}
+
+// hidDevice is the subset of *hid.Device's API the chunked framing below
+// needs, split out so it can be exercised against a fake in tests without
+// a real USB device attached.
+type hidDevice interface {
+	Write(p []byte) (int, error)
+	Read(p []byte) (int, error)
+}
+
+// hidReportSize is the fixed size of a single USB HID report, the unit
+// every Write/Read call to a hid.Device transfers. 64 bytes is the size
+// used by most hardware wallets' vendor-defined HID interfaces (Trezor,
+// Ledger's HID mode, Coldcard). A request or response larger than this,
+// e.g. a multi-input PSBT passed to signtx, has to be split across
+// several reports rather than sent in one Write/Read pair.
+const hidReportSize = 64
+
+// hidLengthPrefixSize is the size of the length prefix written ahead of
+// the payload in the first report, so the reader on the other end knows
+// how many report-sized chunks to expect rather than guessing from
+// whatever a single Read happens to return.
+const hidLengthPrefixSize = 4
+
+// writeHIDFramed writes payload to dev as a length-prefixed sequence of
+// hidReportSize reports, the last one zero-padded if payload doesn't
+// divide evenly.
+func writeHIDFramed(dev hidDevice, payload []byte) error {
+	framed := make([]byte, hidLengthPrefixSize+len(payload))
+	binary.BigEndian.PutUint32(framed[:hidLengthPrefixSize], uint32(len(payload)))
+	copy(framed[hidLengthPrefixSize:], payload)
+
+	for len(framed) > 0 {
+		chunk := make([]byte, hidReportSize)
+		n := copy(chunk, framed)
+		if _, err := dev.Write(chunk); err != nil {
+			return err
+		}
+
+		if n >= len(framed) {
+			break
+		}
+		framed = framed[n:]
+	}
+
+	return nil
+}
+
+// readHIDFramed reads a length-prefixed payload back from dev, issuing as
+// many hidReportSize reads as the length prefix says are needed.
+func readHIDFramed(dev hidDevice) ([]byte, error) {
+	header := make([]byte, hidReportSize)
+	n, err := dev.Read(header)
+	if err != nil {
+		return nil, err
+	}
+	if n < hidLengthPrefixSize {
+		return nil, fmt.Errorf("short read on hardware wallet response header")
+	}
+
+	length := binary.BigEndian.Uint32(header[:hidLengthPrefixSize])
+	result := make([]byte, 0, length)
+	result = append(result, header[hidLengthPrefixSize:n]...)
+
+	for uint32(len(result)) < length {
+		chunk := make([]byte, hidReportSize)
+		n, err := dev.Read(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, chunk[:n]...)
+	}
+
+	return result[:length], nil
+}
+
+func (t *hidTransport) Call(fingerprint string, method string, params interface{}) (json.RawMessage, error) {
+	dev, err := t.device(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	req := hwRequest{Fingerprint: fingerprint, Method: method, Params: params}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHIDFramed(dev, payload); err != nil {
+		return nil, err
+	}
+
+	raw, err := readHIDFramed(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp hwResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("malformed hardware wallet response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("hardware wallet error: %s", resp.Error)
+	}
+
+	return resp.Result, nil
+}
+
+func (t *hidTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for fingerprint, dev := range t.devices {
+		dev.Close()
+		delete(t.devices, fingerprint)
+	}
+
+	return nil
+}
+
+// stdioTransport speaks the line-delimited JSON protocol to a subprocess,
+// e.g. a local `hwi.py` shim or a test simulator.
+type stdioTransport struct {
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	rw  *bufio.ReadWriter
+}
+
+func newStdioTransport(commandLine string) (HwTransport, error) {
+	parts := strings.Fields(commandLine)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty stdio transport target")
+	}
+
+	cmd := exec.Command(parts[0], parts[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+
+	return &stdioTransport{cmd: cmd, rw: rw}, nil
+}
+
+func (t *stdioTransport) Enumerate() ([]HwDeviceInfo, error) {
+	result, err := t.call(hwRequest{Method: "enumerate"})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []HwDeviceInfo
+	if err := json.Unmarshal(result, &devices); err != nil {
+		return nil, fmt.Errorf("malformed enumerate response: %v", err)
+	}
+
+	return devices, nil
+}
+
+func (t *stdioTransport) Call(fingerprint string, method string, params interface{}) (json.RawMessage, error) {
+	return t.call(hwRequest{Fingerprint: fingerprint, Method: method, Params: params})
+}
+
+func (t *stdioTransport) call(req hwRequest) (json.RawMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return doCall(t.rw, req)
+}
+
+func (t *stdioTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	return t.cmd.Wait()
+}
+
+// tcpTransport speaks the same line-delimited JSON protocol over a TCP
+// socket, useful for a remote or out-of-process signer.
+type tcpTransport struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func newTCPTransport(addr string) (HwTransport, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	return &tcpTransport{conn: conn, rw: rw}, nil
+}
+
+func (t *tcpTransport) Enumerate() ([]HwDeviceInfo, error) {
+	result, err := t.call(hwRequest{Method: "enumerate"})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []HwDeviceInfo
+	if err := json.Unmarshal(result, &devices); err != nil {
+		return nil, fmt.Errorf("malformed enumerate response: %v", err)
+	}
+
+	return devices, nil
+}
+
+func (t *tcpTransport) Call(fingerprint string, method string, params interface{}) (json.RawMessage, error) {
+	return t.call(hwRequest{Fingerprint: fingerprint, Method: method, Params: params})
+}
+
+func (t *tcpTransport) call(req hwRequest) (json.RawMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return doCall(t.rw, req)
+}
+
+func (t *tcpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.conn.Close()
+}
@@ -1,8 +1,11 @@
 package waddrmgr
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/btcsuite/btcwallet/internal/zero"
@@ -29,10 +32,21 @@ type KeyMaker interface {
 }
 
 type LocalKeyMaker struct {
-	seed []byte
+	seed        []byte
 	chainParams *chaincfg.Params
 	rootPrivKey *hdkeychain.ExtendedKey
-	manager *Manager
+	manager     *Manager
+
+	// coinType, when non-zero, pins this maker to a single BIP44 coin
+	// type; any scope whose Coin doesn't match is rejected rather than
+	// silently derived. It is left zero (unrestricted) by the legacy
+	// constructors for backwards compatibility. Use
+	// NewLocalKeyMakerFromSeedAndCoin or a KeyMakerRegistry to run
+	// several coin types out of the same wallet.
+	coinType uint32
+
+	cacheOnce sync.Once
+	cache     *keyCache
 }
 
 func NewLocalKeyMaker(rootPrivKey *hdkeychain.ExtendedKey) (KeyMaker, error) {
@@ -43,6 +57,17 @@ func NewLocalKeyMakerFromSeed(seed []byte, chainParams *chaincfg.Params) KeyMake
 	return &LocalKeyMaker{seed: seed, chainParams: chainParams}
 }
 
+// NewLocalKeyMakerFromSeedAndCoin is like NewLocalKeyMakerFromSeed, but
+// pins the resulting KeyMaker to coinType: any scope derived through it
+// whose Coin doesn't match coinType is rejected. A coinType of 0 (Bitcoin
+// mainnet) is indistinguishable from the unrestricted default, so a maker
+// built with 0 is not pinned and derives any coin type. A KeyMakerRegistry
+// can hold, say, a mainnet-BIP84 and a testnet-BIP84 LocalKeyMaker side by
+// side; only the testnet one (coin type 1) refuses the other's scopes.
+func NewLocalKeyMakerFromSeedAndCoin(seed []byte, chainParams *chaincfg.Params, coinType uint32) KeyMaker {
+	return &LocalKeyMaker{seed: seed, chainParams: chainParams, coinType: coinType}
+}
+
 func (s *LocalKeyMaker) CreateMasterKey() (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
 	rootPrivKey, err := hdkeychain.NewMaster(s.seed, s.chainParams)
 	if err != nil {
@@ -67,6 +92,30 @@ func (s *LocalKeyMaker) DeriveCoinTypeKey(scope KeyScope, ns walletdb.ReadWriteB
 		return nil, nil, err
 	}
 
+	// If this maker has been pinned to a single coin type, refuse to
+	// derive any other one rather than silently handing back keys for
+	// the wrong chain.
+	if s.coinType != 0 && scope.Coin != s.coinType {
+		str := fmt.Sprintf(
+			"key maker is pinned to coin type %d, got %d", s.coinType,
+			scope.Coin,
+		)
+		return nil, nil, managerError(ErrCoinTypeTooHigh, str, nil)
+	}
+
+	cacheKey := keyCacheKey{scope: scope, isCoinType: true}
+	if entry, ok := s.keyCache().get(cacheKey); ok && entry.privSerialized != nil {
+		coinTypePrivKey, err := hdkeychain.NewKeyFromString(
+			string(entry.privSerialized),
+		)
+		if err != nil {
+			str := "failed to reconstruct cached cointype private key"
+			return nil, nil, managerError(ErrKeyChain, str, err)
+		}
+
+		return coinTypePrivKey, entry.pubKey, nil
+	}
+
 	if s.rootPrivKey == nil {
 		masterRootPrivEnc, _, err := fetchMasterHDKeys(ns)
 		if err != nil {
@@ -129,6 +178,8 @@ func (s *LocalKeyMaker) DeriveCoinTypeKey(scope KeyScope, ns walletdb.ReadWriteB
 		return nil, nil, errors.New(str)
 	}
 
+	s.cacheKey(cacheKey, coinTypePrivKey, coinTypePubKey)
+
 	return coinTypePrivKey, coinTypePubKey, nil
 }
 
@@ -139,7 +190,24 @@ func (s *LocalKeyMaker) DeriveAccountKey(scope KeyScope, account uint32, ns wall
 		return nil, nil, err
 	}
 
+	cacheKey := keyCacheKey{scope: scope, account: account}
+	if entry, ok := s.keyCache().get(cacheKey); ok && entry.privSerialized != nil {
+		acctKeyPriv, err := hdkeychain.NewKeyFromString(
+			string(entry.privSerialized),
+		)
+		if err != nil {
+			str := "failed to reconstruct cached account private key"
+			return nil, nil, managerError(ErrKeyChain, str, err)
+		}
+
+		return acctKeyPriv, entry.pubKey, nil
+	}
+
 	coinTypePrivKey, _, err := s.DeriveCoinTypeKey(scope, ns, cryptoKeyPriv)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Derive the account key as a child of the coin type key.
 	acctKeyPriv, err := coinTypePrivKey.Child(account + hdkeychain.HardenedKeyStart)
 	if err != nil {
@@ -152,25 +220,358 @@ func (s *LocalKeyMaker) DeriveAccountKey(scope KeyScope, account uint32, ns wall
 		return nil, nil, errors.New(str)
 	}
 
+	s.cacheKey(cacheKey, acctKeyPriv, acctKeyPub)
+
 	return acctKeyPriv, acctKeyPub, nil
 }
 
+// keyCache lazily initializes and returns this maker's bounded LRU cache
+// of neutered (and, while unlocked, private) scope/account keys.
+func (s *LocalKeyMaker) keyCache() *keyCache {
+	s.cacheOnce.Do(func() {
+		s.cache = newKeyCache(defaultKeyCacheSize)
+	})
+
+	return s.cache
+}
+
+// cacheKey stores pubKey under key, along with privKey's serialized form
+// if the cache isn't currently locked. Whether the cache is locked and
+// the insert itself happen atomically from the cache's perspective (see
+// keyCache.putPrivate), so this can never race a concurrent Lock() into
+// leaving a private key behind.
+func (s *LocalKeyMaker) cacheKey(key keyCacheKey, privKey, pubKey *hdkeychain.ExtendedKey) {
+	s.keyCache().putPrivate(key, pubKey, privKey)
+}
+
+// Lock zeroes and drops every cached private key, leaving the cached
+// public xpubs in place. DeriveCoinTypeKey and DeriveAccountKey only
+// serve a cache entry that still holds its private key, so while locked
+// they derive afresh instead. A root private key the maker already holds
+// in memory is kept, and derivations from it still return private keys.
+// Callers (ordinarily a Manager on its own Lock()) must call this to
+// keep cached private key material from outliving the wallet's lock.
+func (s *LocalKeyMaker) Lock() {
+	s.keyCache().lock()
+}
+
+// Unlock marks the maker as unlocked again, allowing private keys to be
+// cached going forward. It does not itself repopulate the cache; the
+// next derivation does that.
+func (s *LocalKeyMaker) Unlock() {
+	s.keyCache().unlock()
+}
+
+// InvalidateCache drops the cached coin-type key for scope along with
+// the cached account key for (scope, account), forcing the next
+// derivation of either to recompute rather than serve a stale entry.
+func (s *LocalKeyMaker) InvalidateCache(scope KeyScope, account uint32) {
+	cache := s.keyCache()
+	cache.invalidate(keyCacheKey{scope: scope, isCoinType: true})
+	cache.invalidate(keyCacheKey{scope: scope, account: account})
+}
+
+// HwTransportType identifies the wire used to reach a RemoteKeyMaker's
+// backing hardware wallet.
+type HwTransportType uint8
+
+const (
+	// HwTransportUSB talks to the device over USB HID, exactly like the
+	// reference HWI tooling does. This is the default for real devices.
+	HwTransportUSB HwTransportType = iota
+
+	// HwTransportStdio launches a subprocess (e.g. `hwi.py`-style shim)
+	// and exchanges one JSON request/response pair per line over its
+	// stdin/stdout. Primarily useful for tests and simulators.
+	HwTransportStdio
+
+	// HwTransportTCP dials a TCP endpoint speaking the same line-delimited
+	// JSON protocol. Useful for out-of-process or remote signers.
+	HwTransportTCP
+)
+
+// HwDeviceInfo describes a single device returned by HwTransport.Enumerate,
+// mirroring the subset of HWI's `enumerate` response fields this package
+// cares about.
+type HwDeviceInfo struct {
+	// Fingerprint is the BIP32 master key fingerprint, hex encoded, that
+	// uniquely identifies the device. The USB HID transport reports the
+	// device's USB serial number here instead, and matches
+	// HwConfig.Fingerprint against that serial number.
+	Fingerprint string
+
+	// Type is the device's reported model, e.g. "trezor" or "ledger".
+	Type string
+
+	// Path is the transport-specific locator for the device (e.g. a USB
+	// path), and is opaque outside of the transport implementation.
+	Path string
+}
+
+// HwTransport abstracts the request/response channel used to speak the
+// HWI-style JSON-RPC protocol to a hardware wallet. Implementations need
+// not be safe for concurrent use.
+type HwTransport interface {
+	// Enumerate lists the hardware wallets currently reachable over this
+	// transport.
+	Enumerate() ([]HwDeviceInfo, error)
+
+	// Call issues method with params to the device identified by
+	// fingerprint and returns its raw JSON result.
+	Call(fingerprint string, method string, params interface{}) (json.RawMessage, error)
+
+	// Close releases any resources (USB handles, subprocesses, sockets)
+	// held by the transport.
+	Close() error
+}
+
+// HwConfig configures a RemoteKeyMaker: which device to talk to, how to
+// reach it, and where in the tree its keys live.
+type HwConfig struct {
+	// Fingerprint is the hex-encoded BIP32 master key fingerprint of the
+	// target device, as reported by `enumerate`. It disambiguates between
+	// multiple devices attached through the same transport.
+	Fingerprint string
+
+	// Transport selects how we talk to the device. Defaults to
+	// HwTransportUSB.
+	Transport HwTransportType
+
+	// TransportTarget is interpreted according to Transport: unused for
+	// HwTransportUSB, the subprocess command line for HwTransportStdio,
+	// and the "host:port" address for HwTransportTCP.
+	TransportTarget string
+
+	// DerivationPathPrefix is the hardened path prefix, e.g. "m", that the
+	// device's own `getxpub` expects its argument to be rooted at. It is
+	// prepended to the purpose/coin/account path segments we derive.
+	DerivationPathPrefix string
+
+	// CoinType, when non-zero, pins this configuration to a single BIP44
+	// coin type. It guards against a RemoteKeyMaker meant for, say,
+	// testnet being handed a mainnet scope by mistake. Zero leaves the
+	// maker unrestricted, so coin type 0 (Bitcoin mainnet) cannot be
+	// pinned. See KeyMakerRegistry for running several coin types side
+	// by side.
+	CoinType uint32
+}
+
+// hwXPubResult is the shape of a successful `getxpub` response.
+type hwXPubResult struct {
+	Xpub string `json:"xpub"`
+}
+
+// hwSignTxResult is the shape of a successful `signtx` response.
+type hwSignTxResult struct {
+	Psbt string `json:"psbt"`
+}
+
+// RemoteKeyMaker is a KeyMaker backed by an external hardware wallet. It
+// never has access to private key material: every method either asks the
+// device to do the signing, or returns a neutered (public-only) key.
 type RemoteKeyMaker struct {
-	hwConfig *HwConfig
+	hwConfig  *HwConfig
+	transport HwTransport
 }
 
+// NewRemoteKeyMaker constructs a RemoteKeyMaker that talks to the device
+// described by hwConfig using the transport it selects.
 func NewRemoteKeyMaker(hwConfig *HwConfig) (KeyMaker, error) {
-	return &RemoteKeyMaker{ hwConfig: hwConfig}, nil
+	transport, err := newHwTransport(hwConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteKeyMaker{hwConfig: hwConfig, transport: transport}, nil
+}
+
+// newHwTransport builds the HwTransport selected by cfg.Transport.
+func newHwTransport(cfg *HwConfig) (HwTransport, error) {
+	switch cfg.Transport {
+	case HwTransportUSB:
+		return newHIDTransport()
+	case HwTransportStdio:
+		return newStdioTransport(cfg.TransportTarget)
+	case HwTransportTCP:
+		return newTCPTransport(cfg.TransportTarget)
+	default:
+		return nil, fmt.Errorf("unknown hardware wallet transport type %v", cfg.Transport)
+	}
 }
 
+// CreateMasterKey is never supported for a RemoteKeyMaker: hardware
+// devices are designed to never expose the master private key to the
+// host, so there is nothing this call could legitimately return.
 func (s *RemoteKeyMaker) CreateMasterKey() (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
-	panic("implement me")
+	str := "hardware wallets do not expose the master private key"
+	return nil, nil, managerError(ErrWatchingOnly, str, nil)
 }
 
+// DeriveCoinTypeKey asks the device for the neutered extended public key
+// at m/purpose'/coin'. The returned private key is always nil; callers
+// must be prepared to operate on the public key alone.
 func (s *RemoteKeyMaker) DeriveCoinTypeKey(scope KeyScope, ns walletdb.ReadWriteBucket, cryptoKeyPriv EncryptorDecryptor) (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
-	panic("implement me")
+	if scope.Coin > maxCoinType {
+		err := managerError(ErrCoinTypeTooHigh, errCoinTypeTooHigh, nil)
+		return nil, nil, err
+	}
+	if err := s.checkCoinType(scope); err != nil {
+		return nil, nil, err
+	}
+
+	path := fmt.Sprintf(
+		"%s/%d'/%d'", s.hwConfig.DerivationPathPrefix, scope.Purpose,
+		scope.Coin,
+	)
+	coinTypePubKey, err := s.getXPub(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, coinTypePubKey, nil
 }
 
+// DeriveAccountKey asks the device for the neutered extended public key
+// at m/purpose'/coin'/account'. The returned private key is always nil;
+// signing must go through SignWithRemote instead.
 func (s *RemoteKeyMaker) DeriveAccountKey(scope KeyScope, account uint32, ns walletdb.ReadWriteBucket, cryptoKeyPriv EncryptorDecryptor) (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
-	panic("implement me")
+	if account > MaxAccountNum {
+		err := managerError(ErrAccountNumTooHigh, errAcctTooHigh, nil)
+		return nil, nil, err
+	}
+	if err := s.checkCoinType(scope); err != nil {
+		return nil, nil, err
+	}
+
+	path := fmt.Sprintf(
+		"%s/%d'/%d'/%d'", s.hwConfig.DerivationPathPrefix, scope.Purpose,
+		scope.Coin, account,
+	)
+	acctPubKey, err := s.getXPub(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, acctPubKey, nil
+}
+
+// checkCoinType rejects scope if this maker's hwConfig pins it to a
+// single coin type and scope.Coin doesn't match, rather than silently
+// asking the device to derive keys for the wrong chain.
+func (s *RemoteKeyMaker) checkCoinType(scope KeyScope) error {
+	if s.hwConfig.CoinType != 0 && scope.Coin != s.hwConfig.CoinType {
+		str := fmt.Sprintf(
+			"hardware wallet is pinned to coin type %d, got %d",
+			s.hwConfig.CoinType, scope.Coin,
+		)
+		return managerError(ErrCoinTypeTooHigh, str, nil)
+	}
+
+	return nil
+}
+
+// getXPub performs the HWI-style `getxpub <path>` call and parses the
+// result into an extended public key.
+func (s *RemoteKeyMaker) getXPub(path string) (*hdkeychain.ExtendedKey, error) {
+	result, err := s.transport.Call(
+		s.hwConfig.Fingerprint, "getxpub",
+		map[string]string{"path": path},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("hardware wallet getxpub failed: %v", err)
+	}
+
+	var resp hwXPubResult
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return nil, fmt.Errorf("malformed getxpub response: %v", err)
+	}
+
+	xpub, err := hdkeychain.NewKeyFromString(resp.Xpub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xpub returned by device: %v", err)
+	}
+
+	return xpub, nil
+}
+
+// SignWithRemote sends a serialized PSBT to the device for the `signtx`
+// call and returns the (partially or fully) signed PSBT it hands back.
+// This is how an account whose keys were sourced from a RemoteKeyMaker
+// round-trips a transaction through the hardware signer.
+func (s *RemoteKeyMaker) SignWithRemote(psbt []byte) ([]byte, error) {
+	result, err := s.transport.Call(
+		s.hwConfig.Fingerprint, "signtx",
+		map[string]string{"psbt": string(psbt)},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("hardware wallet signtx failed: %v", err)
+	}
+
+	var resp hwSignTxResult
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return nil, fmt.Errorf("malformed signtx response: %v", err)
+	}
+
+	return []byte(resp.Psbt), nil
+}
+
+// WatchOnlyKeyMaker is a KeyMaker seeded from a single, already-public
+// account-level extended key (an xpub/ypub/zpub export from a Coldcard,
+// Trezor, Ledger, etc.) rather than from a seed or master key. It never
+// has, and never needs, any private key material: it can only serve the
+// one scope/account its xpub was exported for.
+type WatchOnlyKeyMaker struct {
+	scope       KeyScope
+	account     uint32
+	accountXPub *hdkeychain.ExtendedKey
+}
+
+// NewWatchOnlyKeyMaker constructs a WatchOnlyKeyMaker that serves
+// accountXPub for exactly the given scope and account number. accountXPub
+// must already be a neutered (public) extended key; its HD version bytes
+// are preserved as-is, so it round-trips as whichever xpub/ypub/zpub
+// variant the user imported.
+func NewWatchOnlyKeyMaker(accountXPub *hdkeychain.ExtendedKey, scope KeyScope, account uint32) (KeyMaker, error) {
+	if accountXPub == nil {
+		return nil, errors.New("account key imported into a WatchOnlyKeyMaker must not be nil")
+	}
+	if accountXPub.IsPrivate() {
+		str := "account key imported into a WatchOnlyKeyMaker must be " +
+			"a neutered extended public key"
+		return nil, errors.New(str)
+	}
+
+	return &WatchOnlyKeyMaker{
+		scope:       scope,
+		account:     account,
+		accountXPub: accountXPub,
+	}, nil
+}
+
+// CreateMasterKey always fails for a WatchOnlyKeyMaker: it was never
+// given a seed or master key, only a single account's public key.
+func (s *WatchOnlyKeyMaker) CreateMasterKey() (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
+	return nil, nil, managerError(ErrWatchingOnly, "", nil)
+}
+
+// DeriveCoinTypeKey always fails for a WatchOnlyKeyMaker: only the single
+// imported account key is available, not the coin-type key above it.
+func (s *WatchOnlyKeyMaker) DeriveCoinTypeKey(scope KeyScope, ns walletdb.ReadWriteBucket, cryptoKeyPriv EncryptorDecryptor) (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
+	return nil, nil, managerError(ErrWatchingOnly, "", nil)
+}
+
+// DeriveAccountKey returns the imported xpub if scope and account match
+// what it was imported for, and errors otherwise. The private key is
+// always nil.
+func (s *WatchOnlyKeyMaker) DeriveAccountKey(scope KeyScope, account uint32, ns walletdb.ReadWriteBucket, cryptoKeyPriv EncryptorDecryptor) (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
+	if scope != s.scope || account != s.account {
+		str := fmt.Sprintf(
+			"watch-only key maker only has the account key for "+
+				"scope %v account %d, got scope %v account %d",
+			s.scope, s.account, scope, account,
+		)
+		return nil, nil, managerError(ErrWatchingOnly, str, nil)
+	}
+
+	return nil, s.accountXPub, nil
 }
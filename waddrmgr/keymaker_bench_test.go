@@ -0,0 +1,77 @@
+package waddrmgr
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+// benchRootKey returns a deterministic master key to derive from, so the
+// two benchmarks below exercise identical derivations.
+func benchRootKey(b *testing.B) *hdkeychain.ExtendedKey {
+	b.Helper()
+
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	rootKey, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		b.Fatalf("unable to create master key: %v", err)
+	}
+
+	return rootKey
+}
+
+// BenchmarkDeriveAccountKey measures repeated account derivation against
+// the same scope/account pair, the pattern address generation and
+// rescans hit constantly. With the cache this should settle into a map
+// lookup plus a reparse of the cached serialized private key after the
+// first call; the "NoCache" variant below shows the
+// decrypt-and-derive cost it replaces.
+func BenchmarkDeriveAccountKey(b *testing.B) {
+	rootKey := benchRootKey(b)
+	scope := KeyScope{Purpose: 84, Coin: 0}
+
+	km, err := NewLocalKeyMaker(rootKey)
+	if err != nil {
+		b.Fatalf("unable to create key maker: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := km.DeriveAccountKey(scope, 0, nil, nil); err != nil {
+			b.Fatalf("unable to derive account key: %v", err)
+		}
+	}
+}
+
+// BenchmarkDeriveAccountKeyNoCache isolates the cost BenchmarkDeriveAccountKey's
+// cache eliminates. DeriveCoinTypeKey only takes the expensive path when
+// s.rootPrivKey is nil, decrypting and reparsing the root key from the
+// database on every call; fetchMasterHDKeys and EncryptorDecryptor.Decrypt,
+// the pieces that actually hit the DB and run AES, are not defined in
+// the files of this package here, so this benchmark stands
+// in for them by reparsing the root key's serialized form from scratch
+// every iteration, which is the dominant cost that decrypt path shares.
+func BenchmarkDeriveAccountKeyNoCache(b *testing.B) {
+	rootKey := benchRootKey(b)
+	serializedRoot := rootKey.String()
+	scope := KeyScope{Purpose: 84, Coin: 0}
+
+	km := &LocalKeyMaker{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root, err := hdkeychain.NewKeyFromString(serializedRoot)
+		if err != nil {
+			b.Fatalf("unable to reparse root key: %v", err)
+		}
+		km.rootPrivKey = root
+
+		if _, _, err := km.DeriveAccountKey(scope, 0, nil, nil); err != nil {
+			b.Fatalf("unable to derive account key: %v", err)
+		}
+
+		km.rootPrivKey = nil
+		km.InvalidateCache(scope, 0)
+	}
+}
@@ -0,0 +1,106 @@
+package waddrmgr
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+func testAccountXPub(t *testing.T) *hdkeychain.ExtendedKey {
+	t.Helper()
+
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	priv, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create master key: %v", err)
+	}
+
+	pub, err := priv.Neuter()
+	if err != nil {
+		t.Fatalf("unable to neuter master key: %v", err)
+	}
+
+	return pub
+}
+
+func TestNewWatchOnlyKeyMakerRejectsNilXPub(t *testing.T) {
+	scope := KeyScope{Purpose: 84, Coin: 0}
+
+	if _, err := NewWatchOnlyKeyMaker(nil, scope, 0); err == nil {
+		t.Fatal("expected error constructing WatchOnlyKeyMaker with a nil xpub")
+	}
+}
+
+func TestNewWatchOnlyKeyMakerRejectsPrivateKey(t *testing.T) {
+	scope := KeyScope{Purpose: 84, Coin: 0}
+
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	priv, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create master key: %v", err)
+	}
+
+	if _, err := NewWatchOnlyKeyMaker(priv, scope, 0); err == nil {
+		t.Fatal("expected error constructing WatchOnlyKeyMaker with a private key")
+	}
+}
+
+func TestWatchOnlyKeyMakerDeriveAccountKey(t *testing.T) {
+	scope := KeyScope{Purpose: 84, Coin: 0}
+	xpub := testAccountXPub(t)
+
+	km, err := NewWatchOnlyKeyMaker(xpub, scope, 7)
+	if err != nil {
+		t.Fatalf("unable to create watch-only key maker: %v", err)
+	}
+
+	privKey, pubKey, err := km.DeriveAccountKey(scope, 7, nil, nil)
+	if err != nil {
+		t.Fatalf("unable to derive account key: %v", err)
+	}
+	if privKey != nil {
+		t.Fatal("expected nil private key from a watch-only key maker")
+	}
+	if pubKey.String() != xpub.String() {
+		t.Fatalf("expected derived key %v, got %v", xpub, pubKey)
+	}
+}
+
+func TestWatchOnlyKeyMakerDeriveAccountKeyMismatch(t *testing.T) {
+	scope := KeyScope{Purpose: 84, Coin: 0}
+	xpub := testAccountXPub(t)
+
+	km, err := NewWatchOnlyKeyMaker(xpub, scope, 7)
+	if err != nil {
+		t.Fatalf("unable to create watch-only key maker: %v", err)
+	}
+
+	// A different account number under the same scope must be rejected.
+	if _, _, err := km.DeriveAccountKey(scope, 8, nil, nil); err == nil {
+		t.Fatal("expected error deriving a mismatched account number")
+	}
+
+	// A different scope at the same account number must be rejected too.
+	otherScope := KeyScope{Purpose: 44, Coin: 0}
+	if _, _, err := km.DeriveAccountKey(otherScope, 7, nil, nil); err == nil {
+		t.Fatal("expected error deriving a mismatched scope")
+	}
+}
+
+func TestWatchOnlyKeyMakerNoMasterOrCoinTypeKey(t *testing.T) {
+	scope := KeyScope{Purpose: 84, Coin: 0}
+	xpub := testAccountXPub(t)
+
+	km, err := NewWatchOnlyKeyMaker(xpub, scope, 0)
+	if err != nil {
+		t.Fatalf("unable to create watch-only key maker: %v", err)
+	}
+
+	if _, _, err := km.CreateMasterKey(); err == nil {
+		t.Fatal("expected error creating a master key on a watch-only key maker")
+	}
+	if _, _, err := km.DeriveCoinTypeKey(scope, nil, nil); err == nil {
+		t.Fatal("expected error deriving a cointype key on a watch-only key maker")
+	}
+}
@@ -0,0 +1,49 @@
+package keyring
+
+import (
+	"encoding/binary"
+
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// indexBucketName is the sub-bucket, within the ring's namespace, that
+// holds the next-unused-index counter for every family that has had a
+// key derived from it.
+var indexBucketName = []byte("keyringnextindex")
+
+// familyKey encodes family as the big-endian bucket key its counter is
+// stored under.
+func familyKey(family KeyFamily) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(family))
+	return key[:]
+}
+
+// fetchNextIndex returns the next unused child index for family,
+// defaulting to zero if no key has been derived for it yet.
+func fetchNextIndex(ns walletdb.ReadWriteBucket, family KeyFamily) (uint32, error) {
+	indexBucket, err := ns.CreateBucketIfNotExists(indexBucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	val := indexBucket.Get(familyKey(family))
+	if val == nil {
+		return 0, nil
+	}
+
+	return binary.BigEndian.Uint32(val), nil
+}
+
+// putNextIndex persists index as the next unused child index for family.
+func putNextIndex(ns walletdb.ReadWriteBucket, family KeyFamily, index uint32) error {
+	indexBucket, err := ns.CreateBucketIfNotExists(indexBucketName)
+	if err != nil {
+		return err
+	}
+
+	var val [4]byte
+	binary.BigEndian.PutUint32(val[:], index)
+
+	return indexBucket.Put(familyKey(family), val[:])
+}
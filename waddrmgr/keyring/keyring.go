@@ -0,0 +1,295 @@
+// Package keyring adapts any waddrmgr.KeyMaker into a stable, LN-style key
+// hierarchy that downstream projects (Lightning nodes, DLC daemons,
+// chantools-style tooling) can derive from without reinventing their own
+// wrapper around the wallet's BIP32 key sources.
+package keyring
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// keyRingPurpose is the BIP43 purpose field this package derives all of
+// its keys under. It is reserved for this hierarchy alone so that it
+// never collides with the wallet's own BIP44/49/84 account scopes.
+const keyRingPurpose = 1017
+
+// externalBranch is the only branch this hierarchy uses; there is no
+// separate internal/change branch because every key here is either a
+// one-off identity key or consumed directly rather than paid to.
+const externalBranch = 0
+
+// KeyFamily groups a logical class of keys (e.g. node identity, funding
+// multi-sig, revocation) under its own hardened account within the key
+// ring's scope, so that compromising one family's keys reveals nothing
+// about any other family's.
+type KeyFamily uint32
+
+// KeyLocator pins down a single key as a family and the index of that key
+// within the family's derivation chain.
+type KeyLocator struct {
+	// Family is the KeyFamily the key was derived under.
+	Family KeyFamily
+
+	// Index is the child index of the key within Family's chain.
+	Index uint32
+}
+
+// KeyDescriptor pairs a KeyLocator with the public key it derives to, so
+// that callers which only need the public half never have to touch the
+// wallet again to resolve it.
+type KeyDescriptor struct {
+	KeyLocator
+
+	// PubKey is the public key the locator derives to.
+	PubKey *btcec.PublicKey
+}
+
+// KeyRing produces deterministic public keys from a hierarchy rooted at
+// m/1017'/coin'/family'/0/index, independent of the wallet's own BIP44
+// account structure.
+type KeyRing interface {
+	// DeriveNextKey derives the next unused key in family's chain,
+	// persists the advanced index, and returns the resulting descriptor.
+	DeriveNextKey(family KeyFamily) (KeyDescriptor, error)
+
+	// DeriveKey derives the key at loc without touching any persisted
+	// index counter.
+	DeriveKey(loc KeyLocator) (KeyDescriptor, error)
+}
+
+// SecretKeyRing extends KeyRing with access to the private material
+// backing a descriptor. It can only be satisfied when the underlying
+// waddrmgr.KeyMaker is able to produce private keys.
+type SecretKeyRing interface {
+	KeyRing
+
+	// DerivePrivKey derives the private key behind keyDesc.
+	DerivePrivKey(keyDesc KeyDescriptor) (*btcec.PrivateKey, error)
+
+	// ECDH performs a scalar multiplication of pubKey by the private key
+	// behind keyDesc, returning sha256 of the resulting point's
+	// compressed serialization.
+	ECDH(keyDesc KeyDescriptor, pubKey *btcec.PublicKey) ([32]byte, error)
+}
+
+// BIP32KeyRing implements both KeyRing and SecretKeyRing on top of a
+// waddrmgr.KeyMaker, rather than duplicating its own seed handling.
+type BIP32KeyRing struct {
+	keyMaker waddrmgr.KeyMaker
+	coinType uint32
+	db       walletdb.DB
+
+	// namespaceKey is the ring's own bucket, holding only the
+	// per-family next-index counters in index.go. It must never be
+	// handed to keyMaker: a LocalKeyMaker decrypting its root key looks
+	// for the wallet's master key material in whatever bucket it's
+	// given, and this one never holds any.
+	namespaceKey []byte
+
+	// managerNamespaceKey is the wallet's own addrmgr namespace bucket,
+	// the one keyMaker expects to find its master key material (and any
+	// of its own bookkeeping) in. This is what every call into keyMaker
+	// must be passed as ns.
+	managerNamespaceKey []byte
+
+	cryptoKeyPriv waddrmgr.EncryptorDecryptor
+}
+
+// NewKeyRing wraps keyMaker into a BIP32KeyRing deriving every key under
+// m/1017'/coinType'/family'/0/index. namespaceKey is the top-level
+// walletdb bucket the ring's own per-family index counters are stored
+// in; managerNamespaceKey is the wallet's own addrmgr namespace bucket,
+// the one keyMaker itself expects to be handed on every derive call.
+// The two must be distinct buckets: the ring's bucket never holds master
+// key material, so passing it to keyMaker instead of
+// managerNamespaceKey would make every derivation from a locked
+// LocalKeyMaker fail as if the wallet were watching-only.
+func NewKeyRing(keyMaker waddrmgr.KeyMaker, coinType uint32, db walletdb.DB,
+	namespaceKey, managerNamespaceKey []byte,
+	cryptoKeyPriv waddrmgr.EncryptorDecryptor) (*BIP32KeyRing, error) {
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		_, err := tx.CreateTopLevelBucket(namespaceKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize key ring bucket: %v", err)
+	}
+
+	return &BIP32KeyRing{
+		keyMaker:            keyMaker,
+		coinType:            coinType,
+		db:                  db,
+		namespaceKey:        namespaceKey,
+		managerNamespaceKey: managerNamespaceKey,
+		cryptoKeyPriv:       cryptoKeyPriv,
+	}, nil
+}
+
+// scope returns the KeyScope every family in this ring is derived under.
+func (k *BIP32KeyRing) scope() waddrmgr.KeyScope {
+	return waddrmgr.KeyScope{Purpose: keyRingPurpose, Coin: k.coinType}
+}
+
+// deriveFamilyKey derives the key at the given family/branch/index,
+// returning both halves the underlying KeyMaker is willing to hand back
+// (the private half may be nil for a watch-only or remote KeyMaker).
+// managerNS must be the wallet's own addrmgr namespace bucket, not the
+// ring's index-counter bucket; see managerNamespaceKey.
+func (k *BIP32KeyRing) deriveFamilyKey(managerNS walletdb.ReadWriteBucket, family KeyFamily,
+	index uint32) (*hdkeychain.ExtendedKey, *hdkeychain.ExtendedKey, error) {
+
+	acctPriv, acctPub, err := k.keyMaker.DeriveAccountKey(
+		k.scope(), uint32(family), managerNS, k.cryptoKeyPriv,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var privKey *hdkeychain.ExtendedKey
+	if acctPriv != nil {
+		branchPriv, err := acctPriv.Child(externalBranch)
+		if err != nil {
+			return nil, nil, err
+		}
+		privKey, err = branchPriv.Child(index)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	branchPub, err := acctPub.Child(externalBranch)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubKey, err := branchPub.Child(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return privKey, pubKey, nil
+}
+
+// DeriveNextKey derives the next unused key in family's chain, persists
+// the advanced index, and returns the resulting descriptor.
+func (k *BIP32KeyRing) DeriveNextKey(family KeyFamily) (KeyDescriptor, error) {
+	var desc KeyDescriptor
+
+	err := walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(k.namespaceKey)
+		managerNS := tx.ReadWriteBucket(k.managerNamespaceKey)
+
+		index, err := fetchNextIndex(ns, family)
+		if err != nil {
+			return err
+		}
+
+		_, pubKey, err := k.deriveFamilyKey(managerNS, family, index)
+		if err != nil {
+			return err
+		}
+
+		ecPubKey, err := pubKey.ECPubKey()
+		if err != nil {
+			return err
+		}
+
+		desc = KeyDescriptor{
+			KeyLocator: KeyLocator{Family: family, Index: index},
+			PubKey:     ecPubKey,
+		}
+
+		return putNextIndex(ns, family, index+1)
+	})
+	if err != nil {
+		return KeyDescriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// DeriveKey derives the key at loc without touching any persisted index
+// counter.
+func (k *BIP32KeyRing) DeriveKey(loc KeyLocator) (KeyDescriptor, error) {
+	var desc KeyDescriptor
+
+	err := walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		managerNS := tx.ReadWriteBucket(k.managerNamespaceKey)
+
+		_, pubKey, err := k.deriveFamilyKey(managerNS, loc.Family, loc.Index)
+		if err != nil {
+			return err
+		}
+
+		ecPubKey, err := pubKey.ECPubKey()
+		if err != nil {
+			return err
+		}
+
+		desc = KeyDescriptor{KeyLocator: loc, PubKey: ecPubKey}
+
+		return nil
+	})
+	if err != nil {
+		return KeyDescriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// DerivePrivKey derives the private key behind keyDesc.
+func (k *BIP32KeyRing) DerivePrivKey(keyDesc KeyDescriptor) (*btcec.PrivateKey, error) {
+	var privKey *btcec.PrivateKey
+
+	err := walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		managerNS := tx.ReadWriteBucket(k.managerNamespaceKey)
+
+		extPriv, _, err := k.deriveFamilyKey(
+			managerNS, keyDesc.Family, keyDesc.Index,
+		)
+		if err != nil {
+			return err
+		}
+		if extPriv == nil {
+			return fmt.Errorf("key ring is watch-only, no private " +
+				"key material is available")
+		}
+
+		privKey, err = extPriv.ECPrivKey()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return privKey, nil
+}
+
+// ECDH performs a scalar multiplication of pubKey by the private key
+// behind keyDesc, returning sha256 of the resulting point's compressed
+// serialization.
+func (k *BIP32KeyRing) ECDH(keyDesc KeyDescriptor, pubKey *btcec.PublicKey) ([32]byte, error) {
+	privKey, err := k.DerivePrivKey(keyDesc)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return ecdh(privKey, pubKey), nil
+}
+
+// ecdh is the scalar-multiplication-then-hash at the heart of ECDH,
+// split out from BIP32KeyRing.ECDH so it can be exercised directly
+// without needing a full KeyMaker/walletdb round trip.
+func ecdh(privKey *btcec.PrivateKey, pubKey *btcec.PublicKey) [32]byte {
+	var point btcec.PublicKey
+	x, y := btcec.S256().ScalarMult(pubKey.X, pubKey.Y, privKey.D.Bytes())
+	point.X, point.Y = x, y
+
+	return sha256.Sum256(point.SerializeCompressed())
+}
@@ -0,0 +1,270 @@
+package waddrmgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// watchOnlyAccountBucketName is the sub-bucket, within the manager's own
+// namespace, that holds the serialized xpub for every account whose
+// KeyMaker never hands back a private key (a RemoteKeyMaker, or an
+// imported WatchOnlyKeyMaker). Storing the string form rather than
+// re-deriving it is what preserves whatever HD version bytes
+// (xpub/ypub/zpub/tpub/upub/vpub) the key was minted with.
+var watchOnlyAccountBucketName = []byte("manager-watchonly-accounts")
+
+// watchOnlyAccountKey encodes scope and account as the big-endian bucket
+// key their watch-only xpub is stored under.
+func watchOnlyAccountKey(scope KeyScope, account uint32) []byte {
+	var key [12]byte
+	binary.BigEndian.PutUint32(key[0:4], scope.Purpose)
+	binary.BigEndian.PutUint32(key[4:8], scope.Coin)
+	binary.BigEndian.PutUint32(key[8:12], account)
+	return key[:]
+}
+
+// putWatchOnlyAccountXPub persists xpub, already base58check-serialized
+// with whatever HD version bytes it was minted with, as the watch-only
+// export for (scope, account).
+func putWatchOnlyAccountXPub(ns walletdb.ReadWriteBucket, scope KeyScope, account uint32, xpub string) error {
+	bucket, err := ns.CreateBucketIfNotExists(watchOnlyAccountBucketName)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(watchOnlyAccountKey(scope, account), []byte(xpub))
+}
+
+// fetchWatchOnlyAccountXPub returns the xpub previously persisted for
+// (scope, account) by putWatchOnlyAccountXPub, or an error if none has
+// been stored.
+func fetchWatchOnlyAccountXPub(ns walletdb.ReadWriteBucket, scope KeyScope, account uint32) (string, error) {
+	bucket, err := ns.CreateBucketIfNotExists(watchOnlyAccountBucketName)
+	if err != nil {
+		return "", err
+	}
+
+	val := bucket.Get(watchOnlyAccountKey(scope, account))
+	if val == nil {
+		return "", fmt.Errorf(
+			"no watch-only xpub stored for scope %v account %d", scope,
+			account,
+		)
+	}
+
+	return string(val), nil
+}
+
+// Manager is the account-level front door onto a wallet's registered
+// KeyMakers: it routes account derivation to whichever KeyMaker owns a
+// scope, and persists the xpub for any account whose KeyMaker can't hand
+// back a private key. Manager itself never reads that stored xpub back;
+// every account it returns is derived through a registered KeyMaker.
+//
+// This covers the KeyMaker integration surface only (registration,
+// account creation, watch-only persistence); it is not a reimplementation
+// of btcwallet's own address-managing Manager, which also owns address
+// derivation and its own master key encryption.
+type Manager struct {
+	db           walletdb.DB
+	namespaceKey []byte
+
+	mu        sync.RWMutex
+	keyMakers map[KeyScope]KeyMaker
+}
+
+// NewManager creates a Manager backed by db, using namespaceKey as its own
+// top-level walletdb bucket. namespaceKey must be distinct from any
+// keyring.BIP32KeyRing's own bucket; see that package's
+// managerNamespaceKey doc comment for why conflating the two is a bug.
+func NewManager(db walletdb.DB, namespaceKey []byte) (*Manager, error) {
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		_, err := tx.CreateTopLevelBucket(namespaceKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize manager bucket: %v", err)
+	}
+
+	return &Manager{
+		db:           db,
+		namespaceKey: namespaceKey,
+		keyMakers:    make(map[KeyScope]KeyMaker),
+	}, nil
+}
+
+// RegisterScope associates km with scope; every account created under
+// scope by NewAccount derives through km, and Manager.Lock/Manager.Unlock
+// below reach km through this registration. If km is a *LocalKeyMaker, it
+// is also handed a back-reference to m.
+func (m *Manager) RegisterScope(scope KeyScope, km KeyMaker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keyMakers[scope] = km
+
+	if local, ok := km.(*LocalKeyMaker); ok {
+		local.manager = m
+	}
+}
+
+// lockableKeyMaker is satisfied by any KeyMaker that caches private key
+// material and needs to be told when the wallet locks or unlocks, such as
+// LocalKeyMaker. A RemoteKeyMaker or WatchOnlyKeyMaker never caches
+// private keys and so doesn't implement it; Lock/Unlock simply skip them.
+type lockableKeyMaker interface {
+	Lock()
+	Unlock()
+}
+
+// invalidatableKeyMaker is satisfied by any KeyMaker that caches derived
+// keys and can be told to drop a single (scope, account) entry.
+type invalidatableKeyMaker interface {
+	InvalidateCache(scope KeyScope, account uint32)
+}
+
+// Lock zeroes any cached private key material held by every registered
+// KeyMaker, the way LocalKeyMaker.Lock does for its own cache. Call this
+// from the same place the wallet itself transitions to locked, so no
+// cached private key outlives the wallet's lock. It does not clear a root
+// private key a LocalKeyMaker holds in memory, so that maker still
+// derives private keys after Lock.
+func (m *Manager) Lock() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, km := range m.keyMakers {
+		if lockable, ok := km.(lockableKeyMaker); ok {
+			lockable.Lock()
+		}
+	}
+}
+
+// Unlock marks every registered KeyMaker that caches private keys as
+// unlocked again, mirroring Lock. Call this from the same place the
+// wallet itself transitions to unlocked.
+func (m *Manager) Unlock() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, km := range m.keyMakers {
+		if lockable, ok := km.(lockableKeyMaker); ok {
+			lockable.Unlock()
+		}
+	}
+}
+
+// InvalidateAccountCache drops any cached key material for (scope,
+// account) from the KeyMaker registered for scope, if that KeyMaker
+// caches at all. Call this wherever the wallet already invalidates other
+// account-level caches on rescan or re-derivation.
+func (m *Manager) InvalidateAccountCache(scope KeyScope, account uint32) {
+	km, err := m.keyMakerFor(scope)
+	if err != nil {
+		return
+	}
+
+	if invalidatable, ok := km.(invalidatableKeyMaker); ok {
+		invalidatable.InvalidateCache(scope, account)
+	}
+}
+
+// keyMakerFor returns the KeyMaker registered for scope, or an error if
+// none has been.
+func (m *Manager) keyMakerFor(scope KeyScope) (KeyMaker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	km, ok := m.keyMakers[scope]
+	if !ok {
+		return nil, fmt.Errorf("no key maker registered for scope %v", scope)
+	}
+
+	return km, nil
+}
+
+// NewAccount derives the account key for (scope, account) through the
+// KeyMaker registered for scope. If that KeyMaker can't hand back a
+// private key (a RemoteKeyMaker, or an imported WatchOnlyKeyMaker), the
+// account's xpub is persisted as watch-only, in the string form it was
+// handed back in. NewAccount fails if no KeyMaker is registered for scope.
+func (m *Manager) NewAccount(scope KeyScope, account uint32, cryptoKeyPriv EncryptorDecryptor) (*Account, error) {
+	km, err := m.keyMakerFor(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var acct *Account
+	err = walletdb.Update(m.db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(m.namespaceKey)
+
+		acctPriv, acctPub, err := km.DeriveAccountKey(scope, account, ns, cryptoKeyPriv)
+		if err != nil {
+			return err
+		}
+
+		if acctPriv == nil {
+			err := putWatchOnlyAccountXPub(ns, scope, account, acctPub.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		acct = &Account{
+			scope:    scope,
+			account:  account,
+			keyMaker: km,
+			pubKey:   acctPub,
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return acct, nil
+}
+
+// Account is a single BIP44-style account surfaced by Manager, scoped to
+// whichever KeyMaker sourced its key.
+type Account struct {
+	scope    KeyScope
+	account  uint32
+	keyMaker KeyMaker
+	pubKey   *hdkeychain.ExtendedKey
+}
+
+// Scope returns the KeyScope the account was derived under.
+func (a *Account) Scope() KeyScope {
+	return a.scope
+}
+
+// AccountNumber returns the account's BIP44 account index.
+func (a *Account) AccountNumber() uint32 {
+	return a.account
+}
+
+// NeuteredKey returns the account's extended public key.
+func (a *Account) NeuteredKey() *hdkeychain.ExtendedKey {
+	return a.pubKey
+}
+
+// SignWithRemote sends psbt to the hardware wallet backing this account's
+// KeyMaker for signing. It only succeeds for an account whose scope was
+// registered with a RemoteKeyMaker; for an account backed by a
+// LocalKeyMaker or a WatchOnlyKeyMaker it returns an error.
+func (a *Account) SignWithRemote(psbt []byte) ([]byte, error) {
+	remote, ok := a.keyMaker.(*RemoteKeyMaker)
+	if !ok {
+		return nil, fmt.Errorf(
+			"account is not backed by a remote hardware wallet",
+		)
+	}
+
+	return remote.SignWithRemote(psbt)
+}
@@ -0,0 +1,162 @@
+package waddrmgr
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+// registryKey identifies a single KeyMaker within a KeyMakerRegistry: a
+// coin type is only meaningful relative to the network it's quoted
+// against, since e.g. coin type 1 means "any testnet" across every coin.
+type registryKey struct {
+	coinType uint32
+	netName  string
+}
+
+// KeyMakerRegistry maps a (coin type, network) pair to the KeyMaker that
+// should service it, so a single wallet can hold accounts for several
+// coins/networks at once (mainnet BTC, testnet BTC, LTC, a custom
+// regtest, ...) each with its own root key.
+type KeyMakerRegistry struct {
+	mu      sync.RWMutex
+	makers  map[registryKey]KeyMaker
+	version map[KeyScope]HDVersions
+}
+
+// NewKeyMakerRegistry returns an empty KeyMakerRegistry.
+func NewKeyMakerRegistry() *KeyMakerRegistry {
+	return &KeyMakerRegistry{
+		makers:  make(map[registryKey]KeyMaker),
+		version: make(map[KeyScope]HDVersions),
+	}
+}
+
+// Register associates km with the given coin type and network. A later
+// call for the same pair replaces the earlier registration.
+func (r *KeyMakerRegistry) Register(coinType uint32, netParams *chaincfg.Params, km KeyMaker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.makers[registryKey{coinType, netParams.Name}] = km
+}
+
+// KeyMakerFor returns the KeyMaker registered for coinType and netParams,
+// or an error if none has been registered.
+func (r *KeyMakerRegistry) KeyMakerFor(coinType uint32, netParams *chaincfg.Params) (KeyMaker, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	km, ok := r.makers[registryKey{coinType, netParams.Name}]
+	if !ok {
+		return nil, fmt.Errorf(
+			"no key maker registered for coin type %d on %s", coinType,
+			netParams.Name,
+		)
+	}
+
+	return km, nil
+}
+
+// HDVersions holds the 4-byte HD extended key version prefixes (the
+// bytes that decode to the familiar "xpub"/"ypub"/"zpub"/"tpub"/"upub"/
+// "vpub" and their private counterparts) that should be used when
+// serializing a key derived under a particular scope.
+type HDVersions struct {
+	// Pub is the version prefix for the neutered (public) key.
+	Pub [4]byte
+
+	// Priv is the version prefix for the private key.
+	Priv [4]byte
+}
+
+// RegisterVersions records the HD version bytes to use when serializing
+// keys derived under scope, so an exported account xpub carries the
+// prefix appropriate for its target chain/script type (e.g. "vpub" for a
+// testnet BIP84 account) rather than always the mainnet BIP44 "xpub".
+func (r *KeyMakerRegistry) RegisterVersions(scope KeyScope, versions HDVersions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.version[scope] = versions
+}
+
+// SerializePubKey renders key, which must be a neutered extended public
+// key, as a base58check string using the public version bytes registered
+// for scope. If no override has been registered, key's own version
+// bytes are left untouched.
+func (r *KeyMakerRegistry) SerializePubKey(scope KeyScope, key *hdkeychain.ExtendedKey) (string, error) {
+	if key.IsPrivate() {
+		return "", fmt.Errorf("key passed to SerializePubKey must be a " +
+			"neutered extended public key")
+	}
+
+	r.mu.RLock()
+	versions, ok := r.version[scope]
+	r.mu.RUnlock()
+
+	if !ok {
+		return key.String(), nil
+	}
+
+	return withHDVersion(key, versions.Pub)
+}
+
+// SerializePrivKey renders key, which must be a private extended key, as
+// a base58check string using the private version bytes registered for
+// scope. If no override has been registered, key's own version bytes
+// are left untouched.
+func (r *KeyMakerRegistry) SerializePrivKey(scope KeyScope, key *hdkeychain.ExtendedKey) (string, error) {
+	if !key.IsPrivate() {
+		return "", fmt.Errorf("key passed to SerializePrivKey must be a " +
+			"private extended key")
+	}
+
+	r.mu.RLock()
+	versions, ok := r.version[scope]
+	r.mu.RUnlock()
+
+	if !ok {
+		return key.String(), nil
+	}
+
+	return withHDVersion(key, versions.Priv)
+}
+
+// withHDVersion re-serializes key with its 4-byte HD version prefix
+// swapped for version, recomputing the trailing base58check checksum.
+// hdkeychain only ever serializes with the version byte baked into the
+// chaincfg.Params it was created with, so overriding it for export (e.g.
+// "vpub" instead of "xpub" for a testnet BIP84 account) has to be done
+// at the encoding layer rather than through the public API.
+func withHDVersion(key *hdkeychain.ExtendedKey, version [4]byte) (string, error) {
+	decoded := base58.Decode(key.String())
+	if len(decoded) != hdVersionedKeyLen {
+		return "", fmt.Errorf(
+			"unexpected serialized extended key length %d", len(decoded),
+		)
+	}
+
+	payload := make([]byte, hdVersionedKeyLen-4)
+	copy(payload, decoded[:hdVersionedKeyLen-4])
+	copy(payload[:4], version[:])
+
+	checksum := doubleSHA256(payload)[:4]
+
+	return base58.Encode(append(payload, checksum...)), nil
+}
+
+// hdVersionedKeyLen is the length, in bytes, of a serialized BIP32
+// extended key: 4 version + 1 depth + 4 parent fingerprint + 4 child
+// number + 32 chain code + 33 key data + 4 checksum.
+const hdVersionedKeyLen = 82
+
+func doubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
@@ -0,0 +1,147 @@
+package waddrmgr
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+// testHDVersions is the testnet BIP84 "vpub"/"vprv" pair of version
+// bytes, recognizably not mainnet BIP44.
+var testHDVersions = HDVersions{
+	Pub:  [4]byte{0x04, 0x5f, 0x1c, 0xf6},
+	Priv: [4]byte{0x04, 0x5f, 0x18, 0xbc},
+}
+
+func TestKeyMakerRegistrySerializeRoundTrip(t *testing.T) {
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	privKey, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create master key: %v", err)
+	}
+	pubKey, err := privKey.Neuter()
+	if err != nil {
+		t.Fatalf("unable to neuter master key: %v", err)
+	}
+
+	scope := KeyScope{Purpose: 84, Coin: 1}
+	registry := NewKeyMakerRegistry()
+	registry.RegisterVersions(scope, testHDVersions)
+
+	serializedPub, err := registry.SerializePubKey(scope, pubKey)
+	if err != nil {
+		t.Fatalf("unable to serialize pub key: %v", err)
+	}
+	serializedPriv, err := registry.SerializePrivKey(scope, privKey)
+	if err != nil {
+		t.Fatalf("unable to serialize priv key: %v", err)
+	}
+
+	// The override must actually have changed the string relative to the
+	// key's own mainnet BIP44 serialization.
+	if serializedPub == pubKey.String() {
+		t.Fatal("expected overridden pub key serialization to differ from the default")
+	}
+	if serializedPriv == privKey.String() {
+		t.Fatal("expected overridden priv key serialization to differ from the default")
+	}
+
+	// Re-parsing the overridden string must still produce the same key
+	// material (i.e. only the version prefix changed, not the payload).
+	rtPub, err := hdkeychain.NewKeyFromString(serializedPub)
+	if err != nil {
+		t.Fatalf("unable to parse overridden pub key: %v", err)
+	}
+	if rtPub.String() != serializedPub {
+		t.Fatalf(
+			"round-tripped pub key %v does not match original %v", rtPub,
+			serializedPub,
+		)
+	}
+
+	rtPriv, err := hdkeychain.NewKeyFromString(serializedPriv)
+	if err != nil {
+		t.Fatalf("unable to parse overridden priv key: %v", err)
+	}
+	origECPriv, err := privKey.ECPrivKey()
+	if err != nil {
+		t.Fatalf("unable to get EC priv key: %v", err)
+	}
+	rtECPriv, err := rtPriv.ECPrivKey()
+	if err != nil {
+		t.Fatalf("unable to get round-tripped EC priv key: %v", err)
+	}
+	if origECPriv.D.Cmp(rtECPriv.D) != 0 {
+		t.Fatal("round-tripped private key scalar does not match the original")
+	}
+}
+
+func TestKeyMakerRegistrySerializeNoOverride(t *testing.T) {
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	privKey, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create master key: %v", err)
+	}
+	pubKey, err := privKey.Neuter()
+	if err != nil {
+		t.Fatalf("unable to neuter master key: %v", err)
+	}
+
+	scope := KeyScope{Purpose: 84, Coin: 0}
+	registry := NewKeyMakerRegistry()
+
+	serializedPub, err := registry.SerializePubKey(scope, pubKey)
+	if err != nil {
+		t.Fatalf("unable to serialize pub key: %v", err)
+	}
+	if serializedPub != pubKey.String() {
+		t.Fatal("expected unregistered scope to leave serialization untouched")
+	}
+}
+
+func TestKeyMakerRegistrySerializeRejectsWrongKeyType(t *testing.T) {
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	privKey, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to create master key: %v", err)
+	}
+	pubKey, err := privKey.Neuter()
+	if err != nil {
+		t.Fatalf("unable to neuter master key: %v", err)
+	}
+
+	scope := KeyScope{Purpose: 84, Coin: 0}
+	registry := NewKeyMakerRegistry()
+	registry.RegisterVersions(scope, testHDVersions)
+
+	if _, err := registry.SerializePubKey(scope, privKey); err == nil {
+		t.Fatal("expected SerializePubKey to reject a private key")
+	}
+	if _, err := registry.SerializePrivKey(scope, pubKey); err == nil {
+		t.Fatal("expected SerializePrivKey to reject a public key")
+	}
+}
+
+func TestKeyMakerRegistryKeyMakerFor(t *testing.T) {
+	registry := NewKeyMakerRegistry()
+
+	km, err := NewLocalKeyMaker(nil)
+	if err != nil {
+		t.Fatalf("unable to create key maker: %v", err)
+	}
+
+	registry.Register(0, &chaincfg.MainNetParams, km)
+
+	got, err := registry.KeyMakerFor(0, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unable to look up registered key maker: %v", err)
+	}
+	if got != km {
+		t.Fatal("looked up key maker does not match the one registered")
+	}
+
+	if _, err := registry.KeyMakerFor(1, &chaincfg.TestNet3Params); err == nil {
+		t.Fatal("expected error looking up an unregistered coin type/network")
+	}
+}